@@ -0,0 +1,35 @@
+package gosmparse
+
+import "fmt"
+
+// CompressionCodec decompresses the payload of a single Blob oneof field.
+// rawSize is the uncompressed size as reported by Blob.raw_size and the
+// returned slice must be exactly that many bytes.
+type CompressionCodec interface {
+	Decompress(src []byte, rawSize int) ([]byte, error)
+}
+
+// compressionCodecs maps a Blob oneof field name to the codec that
+// understands it. "raw" is handled directly by blobData since it requires
+// no decompression; the rest are looked up here so callers can register
+// additional codecs (or replace the built-in ones) with
+// RegisterCompressionCodec.
+var compressionCodecs = map[string]CompressionCodec{
+	"zlib": zlibCodec{},
+	"zstd": zstdCodec{},
+	"lzma": lzmaCodec{},
+}
+
+// RegisterCompressionCodec registers (or replaces) the codec used to
+// decompress a given Blob oneof field: "zlib", "lzma" or "zstd".
+func RegisterCompressionCodec(name string, codec CompressionCodec) {
+	compressionCodecs[name] = codec
+}
+
+func compressionCodec(name string) (CompressionCodec, error) {
+	codec, ok := compressionCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("no compression codec registered for %q", name)
+	}
+	return codec, nil
+}
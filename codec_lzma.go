@@ -0,0 +1,29 @@
+package gosmparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// lzmaCodec decompresses Blob.lzma_data.
+type lzmaCodec struct{}
+
+func (lzmaCodec) Decompress(src []byte, rawSize int) ([]byte, error) {
+	r, err := lzma.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, rawSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if n != rawSize {
+		return nil, fmt.Errorf("expected %v bytes, read %v", rawSize, n)
+	}
+	return buf, nil
+}
@@ -0,0 +1,31 @@
+package gosmparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zlib"
+)
+
+// zlibCodec decompresses Blob.zlib_data. It uses klauspost/compress rather
+// than the stdlib compress/zlib for the faster inflate implementation.
+type zlibCodec struct{}
+
+func (zlibCodec) Decompress(src []byte, rawSize int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := make([]byte, rawSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if n != rawSize {
+		return nil, fmt.Errorf("expected %v bytes, read %v", rawSize, n)
+	}
+	return buf, nil
+}
@@ -0,0 +1,36 @@
+package gosmparse
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdCodec decompresses Blob.zstd_data, the format Geofabrik and others
+// have started publishing planet dumps in.
+type zstdCodec struct{}
+
+// zstdDecoder is shared across all Decompress calls. klauspost/compress/zstd
+// spins up background goroutines per decoder instance, so creating one per
+// blob would dominate runtime on a file with hundreds of thousands of zstd
+// blobs; DecodeAll is safe to call concurrently on a single decoder.
+var zstdDecoder *zstd.Decoder
+
+func init() {
+	d, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	zstdDecoder = d
+}
+
+func (zstdCodec) Decompress(src []byte, rawSize int) ([]byte, error) {
+	buf, err := zstdDecoder.DecodeAll(src, make([]byte, 0, rawSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != rawSize {
+		return nil, fmt.Errorf("expected %v bytes, read %v", rawSize, len(buf))
+	}
+	return buf, nil
+}
@@ -1,13 +1,12 @@
 package gosmparse
 
 import (
-	"bytes"
-	"compress/zlib"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -28,6 +27,86 @@ type Decoder struct {
 	BytesRead uint64
 	Index     *BlobIndex
 	Triggers  []func(int, uint64)
+	// Header is the parsed OSMHeader blob, populated by Parse unless
+	// skipHeaderCheck is set or an interrupted indexing run is resumed from
+	// its .idx.part log (which skips the header check). It exposes the bbox, writing program and
+	// osmosis replication metadata without re-decoding blob 0.
+	Header *OSMPBF.HeaderBlock
+
+	// per-stage worker pool sizes, set via Workers. Zero means "use
+	// GOMAXPROCS" and is resolved lazily when Parse starts.
+	nodeWorkers, wayWorkers, relWorkers int
+
+	// partWriter streams BlobInfo entries to a .idx.part log as blobs are
+	// scanned, set by Parse when FEAT:INDEXING is enabled.
+	partWriter *partWriter
+}
+
+// blobJob pairs a decoded blob with the BlobInfo tracking its position in
+// the index being built, if any. Passing it through the blob channel as a
+// typed struct replaces the previous hack of smuggling the blob's index key
+// back out through Blob.XXX_unrecognized.
+type blobJob struct {
+	blob *OSMPBF.Blob
+	info *BlobInfo
+}
+
+// stage identifies one of the three sequential parsing stages Parse steps
+// through: all node blobs, then all way blobs, then all relation blobs.
+const (
+	stageNode = iota
+	stageWay
+	stageRelation
+	stageCount
+)
+
+// Workers sets the number of concurrent workers used for each parsing
+// stage. Call it before Parse. Ways are typically the bottleneck because of
+// coord lookups, so it's common to give them a larger pool than nodes or
+// relations. A value of 0 leaves that stage's pool size at GOMAXPROCS.
+func (d *Decoder) Workers(nodeN, wayN, relN int) {
+	d.nodeWorkers = nodeN
+	d.wayWorkers = wayN
+	d.relWorkers = relN
+}
+
+// supportedFeatures lists the OSMHeader required_features this parser is
+// able to faithfully interpret. Anything outside this set means the file
+// may contain data we'd silently misread (e.g. a history dump fed to a
+// current-state consumer), so Parse refuses to continue instead.
+var supportedFeatures = map[string]bool{
+	"OsmSchema-V0.6":        true,
+	"DenseNodes":            true,
+	"HistoricalInformation": true,
+	"Sort.Type_then_ID":     true,
+}
+
+// checkRequiredFeatures returns an error naming any required_features the
+// header declares that this parser doesn't know how to interpret.
+func checkRequiredFeatures(header *OSMPBF.HeaderBlock) error {
+	var unsupported []string
+	for _, feature := range header.GetRequiredFeatures() {
+		if !supportedFeatures[feature] {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("unsupported required feature(s): %v", unsupported)
+	}
+	return nil
+}
+
+// parseHeader decompresses and unmarshals the OSMHeader blob.
+func (d *Decoder) parseHeader(blob *OSMPBF.Blob) (*OSMPBF.HeaderBlock, error) {
+	buf, _, err := decompressBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+	header := &OSMPBF.HeaderBlock{}
+	if err := proto.Unmarshal(buf, header); err != nil {
+		return nil, err
+	}
+	return header, nil
 }
 
 // NewDecoder returns a new decoder that reads from r.
@@ -37,8 +116,11 @@ func NewDecoder(r *os.File) *Decoder {
 		QueueSize: 64,
 	}
 
-	// load .idx file if available
-	d.AutoloadIndex()
+	// load .idx file if available; errors are non-fatal here, use
+	// NewDecoderWithOptions to surface them instead.
+	if err := d.AutoloadIndex(); err != nil {
+		log.Println("ignoring index load error:", err)
+	}
 
 	return d
 }
@@ -48,10 +130,23 @@ func (d *Decoder) SeekToOffset(offset int64) {
 	d.r.Seek(offset, 0)
 }
 
+// Close releases any file handle held open by d.Index (the chunked format
+// keeps its source file open for lazy lookups). It does not close the
+// underlying reader passed to NewDecoder, which the caller still owns.
+func (d *Decoder) Close() error {
+	if d.Index == nil {
+		return nil
+	}
+	return d.Index.Close()
+}
+
 // ParseBlob - parse a single blob
 func (d *Decoder) ParseBlob(o OSMReader, offset int64) error {
 
 	if FeatureEnabled("INDEXING") {
+		if d.Index != nil {
+			d.Index.Close()
+		}
 		d.Index = &BlobIndex{}
 		d.Mutex = &sync.Mutex{}
 	}
@@ -59,7 +154,7 @@ func (d *Decoder) ParseBlob(o OSMReader, offset int64) error {
 	d.o = o
 	d.SeekToOffset(offset)
 
-	_, blob, err := d.block()
+	_, blob, info, err := d.block()
 	if err != nil {
 		if err == io.EOF {
 			return nil
@@ -67,7 +162,7 @@ func (d *Decoder) ParseBlob(o OSMReader, offset int64) error {
 		return err
 	}
 
-	err = d.readElements(blob)
+	err = d.readElements(blob, info)
 	if err != nil {
 		return err
 	}
@@ -79,101 +174,222 @@ func (d *Decoder) ParseBlob(o OSMReader, offset int64) error {
 func (d *Decoder) Parse(o OSMReader, skipHeaderCheck bool) error {
 
 	if FeatureEnabled("INDEXING") || nil == d.Index {
+		if d.Index != nil {
+			d.Index.Close()
+		}
 		d.Index = &BlobIndex{}
 	}
 	d.Mutex = &sync.Mutex{}
 
 	d.o = o
 
+	if FeatureEnabled("INDEXING") {
+		partPath, err := filepath.Abs(d.r.Name() + ".idx.part")
+		if err != nil {
+			return &parserError{"resolve partial index path", err}
+		}
+
+		resumed, err := loadPartFile(partPath)
+		if err != nil {
+			return &parserError{"read partial index", err}
+		}
+
+		resumeOffset, ok := contiguousResumeOffset(resumed)
+		if len(resumed) > 0 && !ok {
+			// a gap means some blob earlier in the file was still being
+			// scanned by a sibling worker when a later blob finished and got
+			// appended first - we can't tell which byte range that was, so
+			// trusting any offset here would silently produce an index
+			// missing that range. Discard the partial log and rebuild from
+			// the start instead of resuming over a hole.
+			log.Println("partial index has a gap; discarding and restarting index build")
+			resumed = nil
+			if err := os.Truncate(partPath, 0); err != nil && !os.IsNotExist(err) {
+				return &parserError{"reset partial index", err}
+			}
+		}
+
+		writer, err := newPartWriter(partPath)
+		if err != nil {
+			return &parserError{"open partial index", err}
+		}
+		d.partWriter = writer
+		defer func() {
+			d.partWriter.Close()
+			d.partWriter = nil
+		}()
+
+		if len(resumed) > 0 {
+			d.Index.Blobs = resumed
+			log.Println("resuming index build from offset", resumeOffset)
+			d.SeekToOffset(resumeOffset)
+			d.BytesRead = uint64(resumeOffset)
+			skipHeaderCheck = true
+		}
+	}
+
 	if !skipHeaderCheck {
-		header, _, err := d.block()
+		blobHeader, blob, info, err := d.block()
+		if err != nil {
+			return err
+		}
+		if blobHeader.GetType() != "OSMHeader" {
+			return fmt.Errorf("Invalid header of first data block. Wanted: OSMHeader, have: %s", blobHeader.GetType())
+		}
+
+		header, err := d.parseHeader(blob)
 		if err != nil {
 			return err
 		}
-		// TODO: parser checks
-		if header.GetType() != "OSMHeader" {
-			return fmt.Errorf("Invalid header of first data block. Wanted: OSMHeader, have: %s", header.GetType())
+		if err := checkRequiredFeatures(header); err != nil {
+			return err
+		}
+		d.Header = header
+
+		// the header blob never reaches readElements, so record it in the
+		// partial log here; otherwise the log could never cover offset 0
+		if info != nil && d.partWriter != nil {
+			if err := d.partWriter.Append(info); err != nil {
+				return &parserError{"append partial index", err}
+			}
+		}
+	}
+
+	workerCounts := [stageCount]int{d.nodeWorkers, d.wayWorkers, d.relWorkers}
+	for i, n := range workerCounts {
+		if n == 0 {
+			workerCounts[i] = runtime.GOMAXPROCS(0)
 		}
 	}
 
-	// a waitgroup to keep track of which blobs have been processed
-	var wgBlobs sync.WaitGroup
+	// one channel and worker pool per stage; the feeder only ever has one
+	// of them open at a time, so a node cache built by user code during the
+	// node stage is guaranteed complete before a single way blob is read.
+	var stageChans [stageCount]chan blobJob
+	var stageWG [stageCount]sync.WaitGroup
+	for stage := 0; stage < stageCount; stage++ {
+		stageChans[stage] = make(chan blobJob, d.QueueSize)
+	}
 
-	errChan := make(chan error)
-	// feeder
-	blobs := make(chan *OSMPBF.Blob, d.QueueSize)
+	// errChan is buffered so that a worker (or the feeder) that hits an
+	// error never blocks trying to report it - an unbuffered channel would
+	// leave that goroutine stuck after Parse's select has already consumed
+	// the first error, which in turn would hang the stageWG.Wait() below
+	// that the deferred partWriter.Close() depends on.
+	totalWorkers := workerCounts[stageNode] + workerCounts[stageWay] + workerCounts[stageRelation]
+	errChan := make(chan error, totalWorkers+1)
+
+	// erred is set before anything is sent on errChan, so the feeder can
+	// check it right after a stageWG.Wait() returns to tell "every worker
+	// drained its channel" apart from "a worker hit an error and bailed" -
+	// both make the WaitGroup reach zero, but only the former means a
+	// Trigger's "stage is complete" guarantee actually holds.
+	var erred int32
+
+	for stage := 0; stage < stageCount; stage++ {
+		stage := stage
+		for n := 0; n < workerCounts[stage]; n++ {
+			stageWG[stage].Add(1)
+			go func() {
+				defer stageWG[stage].Done()
+				for job := range stageChans[stage] {
+					if err := d.readElements(job.blob, job.info); err != nil {
+						atomic.StoreInt32(&erred, 1)
+						errChan <- err
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	// feeder: reads blobs in file order and hands each one to the channel
+	// of the current stage, using BlobIndex.Breakpoints to know exactly
+	// when a stage's blobs are exhausted.
 	go func() {
-		defer close(blobs)
+		stage := stageNode
 		for {
-			_, blob, err := d.block()
+			_, blob, info, err := d.block()
 			if err != nil {
-				if err == io.EOF {
-					return
+				if err != io.EOF {
+					atomic.StoreInt32(&erred, 1)
+					errChan <- err
 				}
-				errChan <- err
-				return
+				break
 			}
 
-			wgBlobs.Add(1)
-			blobs <- blob
+			stageChans[stage] <- blobJob{blob: blob, info: info}
 
-			// wait at a breakpoint offset
-			for i, offset := range d.Index.Breakpoints {
-				if d.BytesRead == offset {
-					log.Println("Wait at offset", offset)
-					wgBlobs.Wait()
+			for stage < stageRelation && stage < len(d.Index.Breakpoints) && d.BytesRead == d.Index.Breakpoints[stage] {
+				offset := d.Index.Breakpoints[stage]
+				log.Println("Wait at offset", offset)
+				close(stageChans[stage])
+				stageWG[stage].Wait()
 
-					// if groups are provided in order to sync breakpoints, trigger them
-					for _, trigger := range d.Triggers {
-						log.Println("Trigger", i, offset)
-						trigger(i, offset)
-					}
-					break
-				}
+				fireStageTriggers(d.Triggers, stage, offset, &erred)
+				stage++
 			}
 		}
-	}()
-
-	consumerCount := runtime.GOMAXPROCS(0)
 
-	// a waitgroup to keep track of which goroutines are still live
-	var wg sync.WaitGroup
-
-	for i := 0; i < consumerCount; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for blob := range blobs {
-				err := d.readElements(blob)
-				wgBlobs.Done()
-				if err != nil {
-					errChan <- err
-					return
-				}
-			}
-		}()
-	}
+		// close and drain any stage that never hit a breakpoint (e.g. a
+		// file with no relations) so its workers exit cleanly
+		for ; stage < stageCount; stage++ {
+			close(stageChans[stage])
+			stageWG[stage].Wait()
+		}
+	}()
 
 	finished := make(chan bool)
 	go func() {
-		wg.Wait()
+		for stage := 0; stage < stageCount; stage++ {
+			stageWG[stage].Wait()
+		}
 		finished <- true
 	}()
 	select {
 	case err := <-errChan:
+		// the feeder and any still-running sibling stage workers may still
+		// be calling d.partWriter.Append; wait for them to fully drain
+		// before returning so the deferred Close above doesn't race them.
+		<-finished
 		return err
 	case <-finished:
 
 		// save .idx file if applicable
 		if FeatureEnabled("INDEXING") {
-			d.AutoSaveIndex()
+			if err := d.AutoSaveIndex(); err != nil {
+				return err
+			}
+
+			// the partial log is only useful while a build is in progress
+			partPath, err := filepath.Abs(d.r.Name() + ".idx.part")
+			if err == nil {
+				os.Remove(partPath)
+			}
 		}
 
 		return nil
 	}
 }
 
-func (d *Decoder) block() (*OSMPBF.BlobHeader, *OSMPBF.Blob, error) {
+// fireStageTriggers calls each trigger for the stage that just drained,
+// unless erred indicates a worker (in this stage or another) already hit an
+// error - a stage's WaitGroup reaching zero doesn't distinguish "every blob
+// was scanned" from "a worker errored out and returned early", so firing
+// unconditionally would let a Trigger's "stage is complete" assumption run
+// against a stage that actually died mid-scan.
+func fireStageTriggers(triggers []func(int, uint64), stage int, offset uint64, erred *int32) {
+	if atomic.LoadInt32(erred) != 0 {
+		log.Println("skipping triggers for stage", stage, "after worker error")
+		return
+	}
+	for _, trigger := range triggers {
+		log.Println("Trigger", stage, offset)
+		trigger(stage, offset)
+	}
+}
+
+func (d *Decoder) block() (*OSMPBF.BlobHeader, *OSMPBF.Blob, *BlobInfo, error) {
 
 	// store info
 	// vars required for FEAT:INDEXING
@@ -192,7 +408,7 @@ func (d *Decoder) block() (*OSMPBF.BlobHeader, *OSMPBF.Blob, error) {
 
 	// error checking
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	headerSize := binary.BigEndian.Uint32(headerSizeBuf)
 
@@ -206,12 +422,12 @@ func (d *Decoder) block() (*OSMPBF.BlobHeader, *OSMPBF.Blob, error) {
 	atomic.AddUint64(&d.BytesRead, uint64(byteCount))
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	blobHeader := new(OSMPBF.BlobHeader)
 	if err = proto.Unmarshal(headerBuf, blobHeader); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Blob
@@ -222,35 +438,32 @@ func (d *Decoder) block() (*OSMPBF.BlobHeader, *OSMPBF.Blob, error) {
 	atomic.AddUint64(&d.BytesRead, uint64(byteCount))
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	blob := new(OSMPBF.Blob)
 	if err := proto.Unmarshal(blobBuf, blob); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// store info
+	var info *BlobInfo
 	if FeatureEnabled("INDEXING") {
-		d.Mutex.Lock()
-		d.Index.Blobs = append(d.Index.Blobs, &BlobInfo{
+		info = &BlobInfo{
 			Start: startBytes,
 			Size:  uint64(byteCount),
-		})
-
-		// hack to store the blob index key
-		var key = make([]byte, 8)
-		binary.LittleEndian.PutUint64(key, uint64(len(d.Index.Blobs)-1))
-		blob.XXX_unrecognized = key
+		}
 
+		d.Mutex.Lock()
+		d.Index.Blobs = append(d.Index.Blobs, info)
 		d.Mutex.Unlock()
 	}
 
-	return blobHeader, blob, nil
+	return blobHeader, blob, info, nil
 }
 
-func (d *Decoder) readElements(blob *OSMPBF.Blob) error {
+func (d *Decoder) readElements(blob *OSMPBF.Blob, blobInfo *BlobInfo) error {
 
-	pb, err := d.blobData(blob)
+	pb, compression, err := d.blobData(blob)
 	if err != nil {
 		return err
 	}
@@ -334,43 +547,65 @@ func (d *Decoder) readElements(blob *OSMPBF.Blob) error {
 
 		if FeatureEnabled("INDEXING") {
 			d.Mutex.Lock()
-
-			// hack to retrieve the blob index key
-			var key = int(binary.LittleEndian.Uint64(blob.XXX_unrecognized))
-
-			d.Index.Blobs[key].Groups = append(d.Index.Blobs[key].Groups, info)
+			blobInfo.Groups = append(blobInfo.Groups, info)
+			blobInfo.Compression = compression
 			d.Mutex.Unlock()
 		}
 
 	}
 
+	// the blob is now fully scanned, so it's safe to persist to the
+	// incremental index log
+	if FeatureEnabled("INDEXING") && d.partWriter != nil {
+		if err := d.partWriter.Append(blobInfo); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // should be concurrency safe
-func (d *Decoder) blobData(blob *OSMPBF.Blob) (*OSMPBF.PrimitiveBlock, error) {
-	buf := make([]byte, blob.GetRawSize())
+func (d *Decoder) blobData(blob *OSMPBF.Blob) (*OSMPBF.PrimitiveBlock, string, error) {
+	buf, compression, err := decompressBlob(blob)
+	if err != nil {
+		return nil, compression, err
+	}
+
+	var primitiveBlock = OSMPBF.PrimitiveBlock{}
+	err = proto.Unmarshal(buf, &primitiveBlock)
+	return &primitiveBlock, compression, err
+}
+
+// decompressBlob picks the codec matching whichever Blob oneof field is
+// populated and returns the decompressed data along with the name of the
+// codec used, so callers (e.g. the blob index) can report it.
+func decompressBlob(blob *OSMPBF.Blob) ([]byte, string, error) {
 	switch {
 	case blob.Raw != nil:
-		buf = blob.Raw
+		return blob.Raw, "raw", nil
 	case blob.ZlibData != nil:
-		r, err := zlib.NewReader(bytes.NewReader(blob.GetZlibData()))
+		codec, err := compressionCodec("zlib")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		defer r.Close()
-
-		n, err := io.ReadFull(r, buf)
+		buf, err := codec.Decompress(blob.GetZlibData(), int(blob.GetRawSize()))
+		return buf, "zlib", err
+	case blob.GetZstdData() != nil:
+		codec, err := compressionCodec("zstd")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		if n != int(blob.GetRawSize()) {
-			return nil, fmt.Errorf("expected %v bytes, read %v", blob.GetRawSize(), n)
+		buf, err := codec.Decompress(blob.GetZstdData(), int(blob.GetRawSize()))
+		return buf, "zstd", err
+	case blob.GetLzmaData() != nil:
+		codec, err := compressionCodec("lzma")
+		if err != nil {
+			return nil, "", err
 		}
+		buf, err := codec.Decompress(blob.GetLzmaData(), int(blob.GetRawSize()))
+		return buf, "lzma", err
 	default:
-		return nil, fmt.Errorf("found block with unknown data")
+		return nil, "", fmt.Errorf("found block with unknown data")
 	}
-	var primitiveBlock = OSMPBF.PrimitiveBlock{}
-	err := proto.Unmarshal(buf, &primitiveBlock)
-	return &primitiveBlock, err
 }
@@ -1,26 +1,94 @@
 package gosmparse
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 )
 
-// AutoloadIndex - automatically load index file if one if available
-func (d *Decoder) AutoloadIndex() {
-	idxPath, _ := filepath.Abs(d.r.Name() + ".idx")
-	if _, err := os.Stat(idxPath); err == nil {
-		if nil == d.Index {
-			log.Println("autoload idx:", idxPath)
-			d.Index = &BlobIndex{}
-			d.Index.ReadFromFile(idxPath)
+// parserError wraps a failure encountered while loading or saving the blob
+// index file, preserving the original error so callers can distinguish
+// "no index file" from "corrupt index" from "permission denied".
+type parserError struct {
+	op  string
+	err error
+}
+
+func (e *parserError) Error() string {
+	return fmt.Sprintf("gosmparse: %s: %v", e.op, e.err)
+}
+
+func (e *parserError) Unwrap() error {
+	return e.err
+}
+
+// AutoloadIndex - automatically load index file if one is available. It is
+// not an error for no index file to exist; any other failure (corrupt
+// index, permission denied, ...) is returned wrapped in a *parserError.
+func (d *Decoder) AutoloadIndex() error {
+	idxPath, err := filepath.Abs(d.r.Name() + ".idx")
+	if err != nil {
+		return &parserError{"resolve index path", err}
+	}
+
+	if _, err := os.Stat(idxPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return &parserError{"stat index", err}
+	}
+
+	if nil != d.Index {
+		return nil
+	}
+
+	log.Println("autoload idx:", idxPath)
+	d.Index = &BlobIndex{}
+	if err := d.Index.ReadFromFile(idxPath); err != nil {
+		d.Index = nil
+		return &parserError{"read index", err}
 	}
+	return nil
 }
 
 // AutoSaveIndex - automatically save index file if feature is enabled
-func (d *Decoder) AutoSaveIndex() {
-	idxPath, _ := filepath.Abs(d.r.Name() + ".idx")
+func (d *Decoder) AutoSaveIndex() error {
+	idxPath, err := filepath.Abs(d.r.Name() + ".idx")
+	if err != nil {
+		return &parserError{"resolve index path", err}
+	}
+
 	log.Println("autosave idx:", idxPath)
-	d.Index.WriteToFile(idxPath)
+	if err := d.Index.WriteToFile(idxPath); err != nil {
+		return &parserError{"write index", err}
+	}
+	return nil
+}
+
+// DecoderOptions configures optional behavior for NewDecoderWithOptions.
+type DecoderOptions struct {
+	// RequireIndex causes NewDecoderWithOptions to fail if an .idx file is
+	// present but can't be loaded, instead of silently starting unindexed.
+	RequireIndex bool
+}
+
+// NewDecoderWithOptions returns a new decoder that reads from r, like
+// NewDecoder. When opts.RequireIndex is set, an error encountered while
+// autoloading the .idx file is returned instead of swallowed; otherwise it
+// is logged and ignored, as NewDecoder does.
+func NewDecoderWithOptions(r *os.File, opts DecoderOptions) (*Decoder, error) {
+	var d = &Decoder{
+		r:         r,
+		QueueSize: 64,
+	}
+
+	if err := d.AutoloadIndex(); err != nil {
+		if opts.RequireIndex {
+			return nil, err
+		}
+		log.Println("ignoring index load error:", err)
+	}
+
+	return d, nil
 }
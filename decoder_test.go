@@ -0,0 +1,37 @@
+package gosmparse
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestFireStageTriggersSkipsAfterWorkerError(t *testing.T) {
+	var erred int32
+	atomic.StoreInt32(&erred, 1)
+
+	var calls []int
+	triggers := []func(int, uint64){
+		func(stage int, offset uint64) { calls = append(calls, stage) },
+	}
+
+	fireStageTriggers(triggers, stageNode, 100, &erred)
+
+	if len(calls) != 0 {
+		t.Fatalf("fireStageTriggers called triggers %v after a worker error, want none", calls)
+	}
+}
+
+func TestFireStageTriggersFiresWhenNoError(t *testing.T) {
+	var erred int32
+
+	var calls []int
+	triggers := []func(int, uint64){
+		func(stage int, offset uint64) { calls = append(calls, stage) },
+	}
+
+	fireStageTriggers(triggers, stageWay, 200, &erred)
+
+	if len(calls) != 1 || calls[0] != stageWay {
+		t.Fatalf("fireStageTriggers calls = %v, want [%d]", calls, stageWay)
+	}
+}
@@ -1,10 +1,14 @@
 package gosmparse
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sort"
 )
 
 // GroupInfo - store info about each group
@@ -17,19 +21,108 @@ type GroupInfo struct {
 
 // BlobInfo - store info about each block
 type BlobInfo struct {
-	Groups []*GroupInfo
-	Start  uint64
-	Size   uint64
+	Groups      []*GroupInfo
+	Start       uint64
+	Size        uint64
+	Compression string // name of the codec used to decompress this blob, e.g. "zlib", "zstd", "lzma" or "raw"
 }
 
 // BlobIndex - an index of all blocks in the file
 type BlobIndex struct {
 	Blobs       []*BlobInfo
 	Breakpoints []uint64
+
+	// chunkTable and src are only populated when the index was loaded from
+	// the chunked on-disk format below; they let BlobOffsets/FirstOffsetOfType
+	// resolve lookups without materializing every BlobInfo up front.
+	chunkTable map[chunkID]chunkTableEntry
+	src        io.ReaderAt
+	fanouts    map[string]*fanoutIndex
+	boff       []blobOffset
+	comp       []string
+}
+
+// indexMagic identifies the chunked binary index format introduced to replace
+// the gob encoding. A file whose first four bytes don't match this is assumed
+// to be a legacy gob-encoded index and is decoded with the fallback path.
+var indexMagic = [4]byte{'G', 'S', 'M', 'X'}
+
+// indexVersion is bumped whenever the chunk layout changes incompatibly.
+// v2 added the KeyMin/KeyMax fanout bounds to the NIDX/WIDX/RIDX chunks.
+const indexVersion = 2
+
+// chunkID names a chunk the same way git's commit-graph file names its
+// chunks: a fixed four byte tag.
+type chunkID [4]byte
+
+var (
+	chunkNIDX = chunkID{'N', 'I', 'D', 'X'} // node id ranges -> blob index
+	chunkWIDX = chunkID{'W', 'I', 'D', 'X'} // way id ranges -> blob index
+	chunkRIDX = chunkID{'R', 'I', 'D', 'X'} // relation id ranges -> blob index
+	chunkBOFF = chunkID{'B', 'O', 'F', 'F'} // blob index -> start/size
+	chunkCOMP = chunkID{'C', 'O', 'M', 'P'} // blob index -> compression codec name
+)
+
+// chunkTableEntry records where a chunk lives within the index file.
+type chunkTableEntry struct {
+	Offset uint64
+	Size   uint64
+}
+
+// blobOffset is one entry of the BOFF chunk.
+type blobOffset struct {
+	Start uint64
+	Size  uint64
+}
+
+// rangeEntry is one entry of a NIDX/WIDX/RIDX chunk: the [Low, High] id range
+// covered by a single blob, which resolves to the blob's BOFF entry.
+type rangeEntry struct {
+	Low, High int64
+	Blob      uint32
+}
+
+// fanoutIndex is the in-memory form of a decoded NIDX/WIDX/RIDX chunk: a
+// 256-entry fanout table keyed on which of 256 buckets across
+// [KeyMin, KeyMax] the range's Low id falls into (buckets 0-254 split the
+// range evenly; bucket 255 holds only ids >= KeyMax), plus the id-sorted
+// entries themselves, mirroring git's commit-graph fanout. Unlike git's
+// SHA1 keys, OSM ids aren't hash-distributed - bucketing by raw top byte
+// would put every real-world id in bucket 0 - so the bucket boundaries are
+// scaled to the actual id range covered by this chunk.
+type fanoutIndex struct {
+	KeyMin, KeyMax int64
+	Fanout         [256]uint32
+	Entries        []rangeEntry
+}
+
+// fanoutBucket maps id into one of 256 buckets spanning [keyMin, keyMax].
+// It must be applied identically when building the fanout table and when
+// searching it.
+func fanoutBucket(keyMin, keyMax, id int64) byte {
+	if keyMax <= keyMin || id <= keyMin {
+		return 0
+	}
+	if id >= keyMax {
+		return 255
+	}
+	return byte((uint64(id-keyMin) * 255) / uint64(keyMax-keyMin))
+}
+
+// bucket returns the fanout bucket id falls into for this chunk.
+func (fi *fanoutIndex) bucket(id int64) byte {
+	return fanoutBucket(fi.KeyMin, fi.KeyMax, id)
 }
 
-// BlobOffsets - find the start offset of blob(s) containing desired element
+// BlobOffsets - find the start offset of blob(s) containing desired element.
+// When the index was loaded from the chunked format this is a fanout lookup
+// followed by a bounded binary search; otherwise it falls back to a linear
+// scan over the in-memory Blobs built up during parsing.
 func (i *BlobIndex) BlobOffsets(memtype string, id int64) ([]int64, error) {
+	if i.chunkTable != nil {
+		return i.blobOffsetsFromChunks(memtype, id)
+	}
+
 	var offsets []int64
 	for _, info := range i.Blobs {
 		for _, group := range info.Groups {
@@ -48,8 +141,62 @@ func (i *BlobIndex) BlobOffsets(memtype string, id int64) ([]int64, error) {
 	return offsets, errors.New("not found")
 }
 
+func (i *BlobIndex) blobOffsetsFromChunks(memtype string, id int64) ([]int64, error) {
+	fi, err := i.loadFanout(memtype)
+	if err != nil {
+		return nil, err
+	}
+	if len(fi.Entries) == 0 {
+		return nil, errors.New("not found")
+	}
+
+	b := fi.bucket(id)
+	lo := uint32(0)
+	if b > 0 {
+		lo = fi.Fanout[b-1]
+	}
+	hi := fi.Fanout[b]
+
+	// Entries are sorted by Low and, per Sort.Type_then_ID, form
+	// non-overlapping ranges, so at most one entry can cover id: the last
+	// one (in sort order) whose Low is <= id. The fanout bucket narrows the
+	// binary search to a handful of candidates; the entry immediately below
+	// the resulting boundary is the only one left to check - no scan.
+	n := lo + uint32(sort.Search(int(hi-lo), func(k int) bool {
+		return fi.Entries[lo+uint32(k)].Low > id
+	}))
+
+	var offsets []int64
+	if n > 0 {
+		e := fi.Entries[n-1]
+		if id >= e.Low && id <= e.High {
+			off, err := i.boffOffset(e.Blob)
+			if err != nil {
+				return nil, err
+			}
+			offsets = append(offsets, off)
+		}
+	}
+
+	if len(offsets) > 0 {
+		return offsets, nil
+	}
+	return offsets, errors.New("not found")
+}
+
 // FirstOffsetOfType - find the first offset of blob of desired type
 func (i *BlobIndex) FirstOffsetOfType(memtype string) (int64, error) {
+	if i.chunkTable != nil {
+		fi, err := i.loadFanout(memtype)
+		if err != nil {
+			return 0, err
+		}
+		if len(fi.Entries) == 0 {
+			return 0, errors.New("not found")
+		}
+		return i.boffOffset(fi.Entries[0].Blob)
+	}
+
 	for _, info := range i.Blobs {
 		for _, group := range info.Groups {
 			if group.Type == memtype {
@@ -60,19 +207,314 @@ func (i *BlobIndex) FirstOffsetOfType(memtype string) (int64, error) {
 	return 0, errors.New("not found")
 }
 
-// WriteTo - write to destination
+// loadFanout lazily decodes a single NIDX/WIDX/RIDX chunk from i.src,
+// caching the result so repeated lookups of the same type are free.
+func (i *BlobIndex) loadFanout(memtype string) (*fanoutIndex, error) {
+	if fi, ok := i.fanouts[memtype]; ok {
+		return fi, nil
+	}
+
+	id, ok := chunkIDForType(memtype)
+	if !ok {
+		return nil, fmt.Errorf("unknown element type %q", memtype)
+	}
+
+	entry, ok := i.chunkTable[id]
+	if !ok {
+		return &fanoutIndex{}, nil
+	}
+
+	buf := make([]byte, entry.Size)
+	if _, err := i.src.ReadAt(buf, int64(entry.Offset)); err != nil {
+		return nil, err
+	}
+
+	fi := &fanoutIndex{}
+	r := bytes.NewReader(buf)
+
+	var count uint64
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &fi.KeyMin); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &fi.KeyMax); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &fi.Fanout); err != nil {
+		return nil, err
+	}
+
+	fi.Entries = make([]rangeEntry, count)
+	for n := range fi.Entries {
+		if err := binary.Read(r, binary.BigEndian, &fi.Entries[n].Low); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &fi.Entries[n].High); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &fi.Entries[n].Blob); err != nil {
+			return nil, err
+		}
+	}
+
+	if i.fanouts == nil {
+		i.fanouts = make(map[string]*fanoutIndex)
+	}
+	i.fanouts[memtype] = fi
+	return fi, nil
+}
+
+// boffOffset resolves a blob index into its start offset, loading the BOFF
+// chunk on first use.
+func (i *BlobIndex) boffOffset(blob uint32) (int64, error) {
+	if i.boff == nil {
+		entry, ok := i.chunkTable[chunkBOFF]
+		if !ok {
+			return 0, errors.New("index has no BOFF chunk")
+		}
+
+		buf := make([]byte, entry.Size)
+		if _, err := i.src.ReadAt(buf, int64(entry.Offset)); err != nil {
+			return 0, err
+		}
+
+		r := bytes.NewReader(buf)
+		var count uint64
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return 0, err
+		}
+		i.boff = make([]blobOffset, count)
+		if err := binary.Read(r, binary.BigEndian, &i.boff); err != nil {
+			return 0, err
+		}
+	}
+
+	if int(blob) >= len(i.boff) {
+		return 0, fmt.Errorf("blob index %d out of range", blob)
+	}
+	return int64(i.boff[blob].Start), nil
+}
+
+// CompressionAt resolves a blob index into the name of the codec used to
+// decompress it, loading the COMP chunk on first use. An index written
+// before the COMP chunk existed has no entry for this, in which case the
+// empty string is returned rather than an error.
+func (i *BlobIndex) CompressionAt(blob uint32) (string, error) {
+	if i.comp == nil {
+		entry, ok := i.chunkTable[chunkCOMP]
+		if !ok {
+			return "", nil
+		}
+
+		buf := make([]byte, entry.Size)
+		if _, err := i.src.ReadAt(buf, int64(entry.Offset)); err != nil {
+			return "", err
+		}
+
+		r := bytes.NewReader(buf)
+		var count uint64
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return "", err
+		}
+		comp := make([]string, count)
+		for n := range comp {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return "", err
+			}
+			name := make([]byte, size)
+			if _, err := io.ReadFull(r, name); err != nil {
+				return "", err
+			}
+			comp[n] = string(name)
+		}
+		i.comp = comp
+	}
+
+	if int(blob) >= len(i.comp) {
+		return "", fmt.Errorf("blob index %d out of range", blob)
+	}
+	return i.comp[blob], nil
+}
+
+func chunkIDForType(memtype string) (chunkID, bool) {
+	switch memtype {
+	case "node":
+		return chunkNIDX, true
+	case "way":
+		return chunkWIDX, true
+	case "relation":
+		return chunkRIDX, true
+	}
+	return chunkID{}, false
+}
+
+// WriteTo - write to destination using the chunked binary format: a fixed
+// signature + version header, a table of (chunk id, offset, size), and the
+// NIDX/WIDX/RIDX/BOFF/COMP chunks themselves.
 func (i *BlobIndex) WriteTo(sink io.Writer) (int64, error) {
-	encoder := gob.NewEncoder(sink)
-	err := encoder.Encode(i)
-	return 0, err
+	chunks := i.buildChunks()
+
+	order := []chunkID{chunkNIDX, chunkWIDX, chunkRIDX, chunkBOFF, chunkCOMP}
+
+	var body bytes.Buffer
+	table := make(map[chunkID]chunkTableEntry, len(order))
+	for _, id := range order {
+		data := chunks[id]
+		table[id] = chunkTableEntry{Offset: uint64(body.Len()), Size: uint64(len(data))}
+		body.Write(data)
+	}
+
+	var header bytes.Buffer
+	header.Write(indexMagic[:])
+	binary.Write(&header, binary.BigEndian, uint32(indexVersion))
+	binary.Write(&header, binary.BigEndian, uint32(len(order)))
+
+	headerSize := header.Len() + len(order)*(4+8+8)
+	for _, id := range order {
+		entry := table[id]
+		header.Write(id[:])
+		binary.Write(&header, binary.BigEndian, entry.Offset+uint64(headerSize))
+		binary.Write(&header, binary.BigEndian, entry.Size)
+	}
+
+	n, err := sink.Write(header.Bytes())
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := sink.Write(body.Bytes())
+	return int64(n + m), err
 }
 
-// ReadFrom - read from destination
+// buildChunks turns the in-memory Blobs built up during parsing into the raw
+// bytes of each on-disk chunk.
+func (i *BlobIndex) buildChunks() map[chunkID]([]byte) {
+	ranges := map[chunkID][]rangeEntry{
+		chunkNIDX: nil,
+		chunkWIDX: nil,
+		chunkRIDX: nil,
+	}
+
+	var boff bytes.Buffer
+	binary.Write(&boff, binary.BigEndian, uint64(len(i.Blobs)))
+
+	var comp bytes.Buffer
+	binary.Write(&comp, binary.BigEndian, uint64(len(i.Blobs)))
+
+	for blobIdx, info := range i.Blobs {
+		binary.Write(&boff, binary.BigEndian, blobOffset{Start: info.Start, Size: info.Size})
+
+		name := []byte(info.Compression)
+		binary.Write(&comp, binary.BigEndian, uint32(len(name)))
+		comp.Write(name)
+
+		for _, group := range info.Groups {
+			id, ok := chunkIDForType(group.Type)
+			if !ok {
+				continue
+			}
+			ranges[id] = append(ranges[id], rangeEntry{Low: group.Low, High: group.High, Blob: uint32(blobIdx)})
+		}
+	}
+
+	out := map[chunkID][]byte{chunkBOFF: boff.Bytes(), chunkCOMP: comp.Bytes()}
+	for id, entries := range ranges {
+		sort.Slice(entries, func(a, b int) bool { return entries[a].Low < entries[b].Low })
+
+		var keyMin, keyMax int64
+		if len(entries) > 0 {
+			keyMin = entries[0].Low
+			keyMax = entries[len(entries)-1].Low
+		}
+
+		var fanout [256]uint32
+		for _, e := range entries {
+			fanout[fanoutBucket(keyMin, keyMax, e.Low)]++
+		}
+		for n := 1; n < 256; n++ {
+			fanout[n] += fanout[n-1]
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint64(len(entries)))
+		binary.Write(&buf, binary.BigEndian, keyMin)
+		binary.Write(&buf, binary.BigEndian, keyMax)
+		binary.Write(&buf, binary.BigEndian, fanout)
+		for _, e := range entries {
+			binary.Write(&buf, binary.BigEndian, e.Low)
+			binary.Write(&buf, binary.BigEndian, e.High)
+			binary.Write(&buf, binary.BigEndian, e.Blob)
+		}
+		out[id] = buf.Bytes()
+	}
+
+	return out
+}
+
+// ReadFrom - read from destination. Detects the chunked binary format via
+// its magic header and, when present, parses only the header and chunk
+// table eagerly, leaving the NIDX/WIDX/RIDX/BOFF chunks to be decoded lazily
+// on first lookup. Falls back to decoding a legacy gob-encoded index.
 func (i *BlobIndex) ReadFrom(tap io.Reader) (int64, error) {
-	decoder := gob.NewDecoder(tap)
-	err := decoder.Decode(i)
+	ra, ok := tap.(io.ReaderAt)
+	if !ok {
+		buf, err := io.ReadAll(tap)
+		if err != nil {
+			return 0, err
+		}
+		ra = bytes.NewReader(buf)
+		tap = bytes.NewReader(buf)
+	}
+
+	var magic [4]byte
+	if _, err := io.ReadFull(tap, magic[:]); err != nil {
+		return 0, err
+	}
+
+	if magic != indexMagic {
+		// legacy gob format: re-assemble the bytes we already consumed.
+		decoder := gob.NewDecoder(io.MultiReader(bytes.NewReader(magic[:]), tap))
+		if err := decoder.Decode(i); err != nil {
+			return 0, err
+		}
+		i.SetBreakpoints()
+		return 0, nil
+	}
+
+	r := io.LimitReader(tap, 1<<20) // header + chunk table is always small
+	var version, count uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return 0, err
+	}
+	if version != indexVersion {
+		return 0, fmt.Errorf("unsupported index version %d", version)
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return 0, err
+	}
+
+	table := make(map[chunkID]chunkTableEntry, count)
+	for n := uint32(0); n < count; n++ {
+		var id chunkID
+		var entry chunkTableEntry
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			return 0, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &entry.Offset); err != nil {
+			return 0, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &entry.Size); err != nil {
+			return 0, err
+		}
+		table[id] = entry
+	}
+
+	i.chunkTable = table
+	i.src = ra
 	i.SetBreakpoints()
-	return 0, err
+	return 0, nil
 }
 
 // SetBreakpoints - set the breakpoints for node/way/relation boundaries
@@ -89,19 +531,47 @@ func (i *BlobIndex) SetBreakpoints() {
 }
 
 // WriteToFile - write to disk
-func (i *BlobIndex) WriteToFile(path string) {
+func (i *BlobIndex) WriteToFile(path string) error {
 	file, err := os.Create(path)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	i.WriteTo(file)
+	defer file.Close()
+
+	_, err = i.WriteTo(file)
+	return err
 }
 
 // ReadFromFile - read from disk
-func (i *BlobIndex) ReadFromFile(path string) {
+func (i *BlobIndex) ReadFromFile(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	if _, err := i.ReadFrom(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	// the chunked format keeps the file open as i.src for lazy lookups (see
+	// ReadFrom); the legacy gob format fully decodes up front and has no
+	// further use for it, so close it ourselves instead of leaking the fd.
+	if i.src != file {
+		file.Close()
+	}
+	return nil
+}
+
+// Close releases the underlying file handle kept open by ReadFrom/ReadFromFile
+// for the chunked format's lazy loadFanout/boffOffset/CompressionAt reads. It
+// is a no-op for an index that was built in memory or loaded from the legacy
+// gob format, neither of which keep a source open.
+func (i *BlobIndex) Close() error {
+	closer, ok := i.src.(io.Closer)
+	i.src = nil
+	if !ok {
+		return nil
 	}
-	i.ReadFrom(file)
+	return closer.Close()
 }
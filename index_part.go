@@ -0,0 +1,179 @@
+package gosmparse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// partSyncInterval controls how often the partial index log is fsynced.
+// A crash between syncs loses at most this many blobs' worth of progress
+// rather than the whole run.
+const partSyncInterval = 256
+
+// partWriter appends BlobInfo entries to a "<path>.idx.part" log as blobs
+// are scanned during an indexing Parse, so an interrupted run over a
+// 70+GB planet file still leaves a usable partial index instead of none at
+// all. Each record is length-prefixed gob, written and fsynced
+// incrementally.
+type partWriter struct {
+	file  *os.File
+	mu    sync.Mutex
+	count int
+}
+
+// newPartWriter opens (or creates) the partial index log for appending. Any
+// torn trailing record left by a crash mid-write is truncated away first,
+// so appends always start from a clean record boundary - otherwise the new
+// records would be written after the garbage bytes and their length-prefix
+// framing would never be found again by loadPartFile.
+func newPartWriter(path string) (*partWriter, error) {
+	validLen, err := validPartFileLength(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(validLen); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &partWriter{file: file}, nil
+}
+
+// Append writes one BlobInfo record, fsyncing every partSyncInterval
+// records.
+func (w *partWriter) Append(info *BlobInfo) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(info); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(buf.Len()))
+	if _, err := w.file.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	w.count++
+	if w.count%partSyncInterval == 0 {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// Close flushes and closes the underlying file.
+func (w *partWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// loadPartFile reads a "<path>.idx.part" log left behind by an interrupted
+// run, returning the BlobInfo entries recorded so far. A missing file is
+// not an error - it just means there's nothing to resume. A truncated
+// trailing record (the file was being appended to when the process died)
+// is silently dropped rather than treated as corruption.
+func loadPartFile(path string) ([]*BlobInfo, error) {
+	blobs, _, err := scanPartFile(path)
+	return blobs, err
+}
+
+// validPartFileLength returns the byte offset up to which path holds
+// well-formed length-prefixed records, discarding any torn trailing record
+// left by a crash mid-write. A missing file reports a length of 0.
+func validPartFileLength(path string) (int64, error) {
+	_, validLen, err := scanPartFile(path)
+	return validLen, err
+}
+
+// contiguousResumeOffset returns the byte offset up to which blobs is known
+// to give gapless coverage of the source file starting at 0, and whether
+// that coverage actually holds. Per-stage worker pools (see readElements)
+// append to the partial index in completion order, not file order, so a
+// slower blob earlier in the file can still be unscanned when a faster,
+// later blob is already recorded. Trusting the highest Start+Size in that
+// case would skip the unscanned blob's byte range forever on resume, so
+// callers must check ok and refuse to resume (rather than seek past a gap)
+// when it's false.
+func contiguousResumeOffset(blobs []*BlobInfo) (offset int64, ok bool) {
+	if len(blobs) == 0 {
+		return 0, true
+	}
+
+	sorted := make([]*BlobInfo, len(blobs))
+	copy(sorted, blobs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	if sorted[0].Start != 0 {
+		return 0, false
+	}
+	end := sorted[0].Start + sorted[0].Size
+	for _, info := range sorted[1:] {
+		if info.Start != end {
+			return 0, false
+		}
+		end += info.Size
+	}
+	return int64(end), true
+}
+
+// scanPartFile reads the well-formed records of a "<path>.idx.part" log,
+// returning both the decoded BlobInfo entries and the byte offset at which
+// the last complete record ends. A truncated trailing record (the file was
+// being appended to when the process died) is silently excluded from both.
+func scanPartFile(path string) ([]*BlobInfo, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var blobs []*BlobInfo
+	var validLen int64
+	for {
+		var lenBuf [8]byte
+		if _, err := io.ReadFull(file, lenBuf[:]); err != nil {
+			break
+		}
+
+		buf := make([]byte, binary.BigEndian.Uint64(lenBuf[:]))
+		if _, err := io.ReadFull(file, buf); err != nil {
+			break
+		}
+
+		info := &BlobInfo{}
+		if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(info); err != nil {
+			break
+		}
+		blobs = append(blobs, info)
+		validLen += int64(len(lenBuf)) + int64(len(buf))
+	}
+
+	return blobs, validLen, nil
+}
@@ -0,0 +1,212 @@
+package gosmparse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartWriterResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "planet.osm.pbf.idx.part")
+
+	w, err := newPartWriter(path)
+	if err != nil {
+		t.Fatalf("newPartWriter: %v", err)
+	}
+
+	want := []*BlobInfo{
+		{Start: 0, Size: 10, Compression: "zlib"},
+		{Start: 10, Size: 20, Compression: "zstd"},
+		{Start: 30, Size: 5, Compression: "raw"},
+	}
+	for _, info := range want {
+		if err := w.Append(info); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got, err := loadPartFile(path)
+	if err != nil {
+		t.Fatalf("loadPartFile: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("loadPartFile returned %d entries, want %d", len(got), len(want))
+	}
+	for n, info := range got {
+		if info.Start != want[n].Start || info.Size != want[n].Size || info.Compression != want[n].Compression {
+			t.Fatalf("entry %d = %+v, want %+v", n, info, want[n])
+		}
+	}
+}
+
+func TestPartWriterDropsTruncatedTrailingRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "planet.osm.pbf.idx.part")
+
+	w, err := newPartWriter(path)
+	if err != nil {
+		t.Fatalf("newPartWriter: %v", err)
+	}
+	if err := w.Append(&BlobInfo{Start: 0, Size: 10, Compression: "zlib"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// simulate a crash mid-write: a length prefix with no (or a short) body
+	// following it, as if the process died partway through appending.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 99}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	got, err := loadPartFile(path)
+	if err != nil {
+		t.Fatalf("loadPartFile: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("loadPartFile returned %d entries, want 1 (truncated trailing record dropped)", len(got))
+	}
+}
+
+func TestNewPartWriterTruncatesTornTrailingRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "planet.osm.pbf.idx.part")
+
+	w, err := newPartWriter(path)
+	if err != nil {
+		t.Fatalf("newPartWriter: %v", err)
+	}
+	if err := w.Append(&BlobInfo{Start: 0, Size: 10, Compression: "zlib"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// simulate a crash mid-write, as in TestPartWriterDropsTruncatedTrailingRecord.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 99}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// reopening for append must discard the torn bytes before writing the
+	// resumed run's own record, or its length-prefix framing would be
+	// unreadable from then on.
+	w2, err := newPartWriter(path)
+	if err != nil {
+		t.Fatalf("newPartWriter (resume): %v", err)
+	}
+	if err := w2.Append(&BlobInfo{Start: 10, Size: 20, Compression: "zstd"}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w2.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got, err := loadPartFile(path)
+	if err != nil {
+		t.Fatalf("loadPartFile: %v", err)
+	}
+	want := []*BlobInfo{
+		{Start: 0, Size: 10, Compression: "zlib"},
+		{Start: 10, Size: 20, Compression: "zstd"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("loadPartFile returned %d entries, want %d", len(got), len(want))
+	}
+	for n, info := range got {
+		if info.Start != want[n].Start || info.Size != want[n].Size || info.Compression != want[n].Compression {
+			t.Fatalf("entry %d = %+v, want %+v", n, info, want[n])
+		}
+	}
+}
+
+func TestContiguousResumeOffset(t *testing.T) {
+	cases := []struct {
+		name       string
+		blobs      []*BlobInfo
+		wantOffset int64
+		wantOK     bool
+	}{
+		{
+			name:       "empty",
+			blobs:      nil,
+			wantOffset: 0,
+			wantOK:     true,
+		},
+		{
+			name: "contiguous in file order",
+			blobs: []*BlobInfo{
+				{Start: 0, Size: 10},
+				{Start: 10, Size: 20},
+				{Start: 30, Size: 5},
+			},
+			wantOffset: 35,
+			wantOK:     true,
+		},
+		{
+			name: "contiguous but recorded out of file order",
+			blobs: []*BlobInfo{
+				// as completion-order appends from concurrent workers would
+				// leave them in the .idx.part log.
+				{Start: 30, Size: 5},
+				{Start: 0, Size: 10},
+				{Start: 10, Size: 20},
+			},
+			wantOffset: 35,
+			wantOK:     true,
+		},
+		{
+			name: "gap: an earlier blob never finished scanning",
+			blobs: []*BlobInfo{
+				{Start: 0, Size: 10},
+				// [10, 30) missing - a sibling worker was still on it
+				{Start: 30, Size: 5},
+			},
+			wantOffset: 0,
+			wantOK:     false,
+		},
+		{
+			name: "does not start at zero",
+			blobs: []*BlobInfo{
+				{Start: 10, Size: 20},
+			},
+			wantOffset: 0,
+			wantOK:     false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			offset, ok := contiguousResumeOffset(c.blobs)
+			if offset != c.wantOffset || ok != c.wantOK {
+				t.Fatalf("contiguousResumeOffset() = (%d, %v), want (%d, %v)", offset, ok, c.wantOffset, c.wantOK)
+			}
+		})
+	}
+}
+
+func TestLoadPartFileMissing(t *testing.T) {
+	got, err := loadPartFile(filepath.Join(t.TempDir(), "does-not-exist.idx.part"))
+	if err != nil {
+		t.Fatalf("loadPartFile: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("loadPartFile(missing) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,203 @@
+package gosmparse
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func sampleIndex() *BlobIndex {
+	return &BlobIndex{
+		Blobs: []*BlobInfo{
+			{
+				Start:       0,
+				Size:        100,
+				Compression: "zlib",
+				Groups:      []*GroupInfo{{Type: "node", Low: 1, High: 50, Count: 50}},
+			},
+			{
+				Start:       100,
+				Size:        120,
+				Compression: "zstd",
+				Groups:      []*GroupInfo{{Type: "node", Low: 51, High: 200, Count: 150}},
+			},
+			{
+				Start:       220,
+				Size:        80,
+				Compression: "lzma",
+				Groups:      []*GroupInfo{{Type: "way", Low: 1, High: 30, Count: 30}},
+			},
+		},
+	}
+}
+
+func TestBlobIndexChunkedRoundTrip(t *testing.T) {
+	orig := sampleIndex()
+
+	var buf bytes.Buffer
+	if _, err := orig.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	got := &BlobIndex{}
+	if _, err := got.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+
+	offsets, err := got.BlobOffsets("node", 75)
+	if err != nil {
+		t.Fatalf("BlobOffsets: %v", err)
+	}
+	if len(offsets) != 1 || offsets[0] != 100 {
+		t.Fatalf("BlobOffsets(node, 75) = %v, want [100]", offsets)
+	}
+
+	offsets, err = got.BlobOffsets("way", 10)
+	if err != nil {
+		t.Fatalf("BlobOffsets: %v", err)
+	}
+	if len(offsets) != 1 || offsets[0] != 220 {
+		t.Fatalf("BlobOffsets(way, 10) = %v, want [220]", offsets)
+	}
+
+	if _, err := got.BlobOffsets("relation", 1); err == nil {
+		t.Fatal("BlobOffsets(relation, 1) = nil error, want not found")
+	}
+
+	first, err := got.FirstOffsetOfType("way")
+	if err != nil {
+		t.Fatalf("FirstOffsetOfType: %v", err)
+	}
+	if first != 220 {
+		t.Fatalf("FirstOffsetOfType(way) = %d, want 220", first)
+	}
+
+	// blob ordinals are assigned in the order Blobs was populated, so blob 1
+	// is the second entry in sampleIndex: Compression "zstd".
+	comp, err := got.CompressionAt(1)
+	if err != nil {
+		t.Fatalf("CompressionAt: %v", err)
+	}
+	if comp != "zstd" {
+		t.Fatalf("CompressionAt(1) = %q, want %q", comp, "zstd")
+	}
+}
+
+func TestBlobIndexLegacyGobRoundTrip(t *testing.T) {
+	orig := sampleIndex()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(orig); err != nil {
+		t.Fatalf("gob encode: %v", err)
+	}
+
+	got := &BlobIndex{}
+	if _, err := got.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+
+	offsets, err := got.BlobOffsets("node", 75)
+	if err != nil {
+		t.Fatalf("BlobOffsets: %v", err)
+	}
+	if len(offsets) != 1 || offsets[0] != 100 {
+		t.Fatalf("BlobOffsets(node, 75) = %v, want [100]", offsets)
+	}
+
+	if got.Blobs[1].Compression != "zstd" {
+		t.Fatalf("Blobs[1].Compression = %q, want %q", got.Blobs[1].Compression, "zstd")
+	}
+}
+
+func TestReadFromFileClosesLegacyGobFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fd count introspection via /proc is linux-only")
+	}
+
+	path := filepath.Join(t.TempDir(), "planet.osm.pbf.idx")
+	func() {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		defer f.Close()
+		if err := gob.NewEncoder(f).Encode(sampleIndex()); err != nil {
+			t.Fatalf("gob encode: %v", err)
+		}
+	}()
+
+	before := countOpenFDs(t)
+
+	got := &BlobIndex{}
+	if err := got.ReadFromFile(path); err != nil {
+		t.Fatalf("ReadFromFile: %v", err)
+	}
+	if got.src != nil {
+		t.Fatal("src set for a legacy gob index, want nil")
+	}
+
+	after := countOpenFDs(t)
+	if after > before {
+		t.Fatalf("ReadFromFile leaked a file handle for the legacy gob format: %d fds before, %d after", before, after)
+	}
+}
+
+func countOpenFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("read /proc/self/fd: %v", err)
+	}
+	return len(entries)
+}
+
+func TestBlobIndexCloseReleasesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "planet.osm.pbf.idx")
+
+	if err := sampleIndex().WriteToFile(path); err != nil {
+		t.Fatalf("WriteToFile: %v", err)
+	}
+
+	got := &BlobIndex{}
+	if err := got.ReadFromFile(path); err != nil {
+		t.Fatalf("ReadFromFile: %v", err)
+	}
+	if got.src == nil {
+		t.Fatal("src was not populated by ReadFromFile")
+	}
+
+	if err := got.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got.src != nil {
+		t.Fatal("src still set after Close")
+	}
+
+	// closing an already-closed (or never-opened) index is a no-op, not an
+	// error - callers shouldn't have to track whether Close already ran.
+	if err := got.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestFanoutBucketMonotonic(t *testing.T) {
+	const keyMin, keyMax = 1000, 9000000
+
+	prev := byte(0)
+	for id := int64(keyMin); id <= keyMax; id += (keyMax - keyMin) / 512 {
+		b := fanoutBucket(keyMin, keyMax, id)
+		if b < prev {
+			t.Fatalf("fanoutBucket(%d) = %d, want >= previous bucket %d", id, b, prev)
+		}
+		prev = b
+	}
+	if b := fanoutBucket(keyMin, keyMax, keyMin); b != 0 {
+		t.Fatalf("fanoutBucket(keyMin) = %d, want 0", b)
+	}
+	if b := fanoutBucket(keyMin, keyMax, keyMax); b != 255 {
+		t.Fatalf("fanoutBucket(keyMax) = %d, want 255", b)
+	}
+}